@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitCSV(t *testing.T) {
+	cases := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"a", []string{"a"}},
+		{"a,b,c", []string{"a", "b", "c"}},
+		{" a , b ,,c ", []string{"a", "b", "c"}},
+	}
+
+	for _, c := range cases {
+		got := splitCSV(c.in)
+		if len(got) != len(c.want) {
+			t.Errorf("splitCSV(%q) = %v, want %v", c.in, got, c.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("splitCSV(%q) = %v, want %v", c.in, got, c.want)
+				break
+			}
+		}
+	}
+}
+
+func TestGlobBase(t *testing.T) {
+	cases := []struct {
+		pattern       string
+		wantBase      string
+		wantRecursive bool
+	}{
+		{"src/**/*.go", "src", true},
+		{"src/*.go", "src", false},
+		{"*.go", ".", false},
+		{"**/*.go", ".", true},
+		{"src/pkg/foo.go", filepath.Join("src", "pkg", "foo.go"), false},
+	}
+
+	for _, c := range cases {
+		base, recursive := globBase(c.pattern)
+		if base != c.wantBase || recursive != c.wantRecursive {
+			t.Errorf("globBase(%q) = (%q, %v), want (%q, %v)", c.pattern, base, recursive, c.wantBase, c.wantRecursive)
+		}
+	}
+}
+
+func TestIgnoredExtension(t *testing.T) {
+	cases := []struct {
+		exts []string
+		name string
+		want bool
+	}{
+		{[]string{"swp"}, "foo.swp", true},
+		{[]string{".swp"}, "foo.swp", true},
+		{[]string{"swp"}, "foo.go", false},
+		{nil, "foo.go", false},
+	}
+
+	for _, c := range cases {
+		if got := ignoredExtension(c.exts, c.name); got != c.want {
+			t.Errorf("ignoredExtension(%v, %q) = %v, want %v", c.exts, c.name, got, c.want)
+		}
+	}
+}
+
+func TestMatchesAny(t *testing.T) {
+	cases := []struct {
+		patterns []string
+		name     string
+		want     bool
+	}{
+		{[]string{"*.log"}, "debug.log", true},
+		{[]string{"*.log"}, "src/debug.log", true},
+		{[]string{"vendor/**"}, "vendor/pkg/foo.go", true},
+		{[]string{"*.log"}, "main.go", false},
+	}
+
+	for _, c := range cases {
+		if got := matchesAny(c.patterns, c.name); got != c.want {
+			t.Errorf("matchesAny(%v, %q) = %v, want %v", c.patterns, c.name, got, c.want)
+		}
+	}
+}
+
+func TestNearestGitignore(t *testing.T) {
+	root := t.TempDir()
+	sub := filepath.Join(root, "a", "b")
+	if err := os.MkdirAll(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	content := "# comment\n*.log\n\nvendor/**\n"
+	if err := os.WriteFile(filepath.Join(root, ".gitignore"), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"*.log", "vendor/**"}
+	got := nearestGitignore(sub)
+	if len(got) != len(want) {
+		t.Fatalf("nearestGitignore(%q) = %v, want %v", sub, got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("nearestGitignore(%q) = %v, want %v", sub, got, want)
+		}
+	}
+
+	if got := nearestGitignore(t.TempDir()); got != nil {
+		t.Errorf("nearestGitignore with no .gitignore = %v, want nil", got)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	if got := exitCode(nil); got != 0 {
+		t.Errorf("exitCode(nil) = %d, want 0", got)
+	}
+
+	if got := exitCode(errors.New("boom")); got != -1 {
+		t.Errorf("exitCode(non-exec error) = %d, want -1", got)
+	}
+
+	err := exec.Command("sh", "-c", "exit 7").Run()
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatalf("expected *exec.ExitError, got %T", err)
+	}
+	if got := exitCode(exitErr); got != 7 {
+		t.Errorf("exitCode(exit 7) = %d, want 7", got)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	ctx := actionContext{Path: "foo.go", ModTime: time.Unix(0, 0).UTC(), Event: "WRITE"}
+
+	cases := []struct {
+		tmpl string
+		want string
+	}{
+		{"echo {{.Path}}", "echo foo.go"},
+		{"echo {{.Event}} {{.Path}}", "echo WRITE foo.go"},
+		{"no placeholders", "no placeholders"},
+		// Invalid template syntax falls back to the raw string instead of failing the run
+		{"echo {{.Path", "echo {{.Path"},
+	}
+
+	for _, c := range cases {
+		if got := renderTemplate(c.tmpl, ctx); got != c.want {
+			t.Errorf("renderTemplate(%q) = %q, want %q", c.tmpl, got, c.want)
+		}
+	}
+}
@@ -1,40 +1,92 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"sync"
 	"syscall"
+	"text/template"
 	"time"
 
+	"github.com/bmatcuk/doublestar"
+	"github.com/fsnotify/fsnotify"
+	"github.com/google/shlex"
 	"github.com/spf13/viper"
 	"github.com/urfave/cli"
 )
 
+// defaultDebounce is how long watchFile waits for events to stop arriving
+// before running the command, when --debounce is not set
+const defaultDebounce = 200 * time.Millisecond
+
+// defaultGrace is how long a killed command is given to exit on its own
+// before being sent SIGKILL, when --grace is not set
+const defaultGrace = 5 * time.Second
+
+// defaultActionTimeout bounds how long an http action's webhook POST may take,
+// so a hanging endpoint can't freeze the watcher; copy actions are not bounded
+const defaultActionTimeout = 10 * time.Second
+
 var (
-	cfg     string
-	cmd     string
-	file    string
-	quiet   bool
-	verbose bool
+	cfg       string
+	cmd       string
+	file      string
+	dir       string
+	recursive bool
+	debounce  time.Duration
+	period    time.Duration
+	grace     time.Duration
+	restart   string
+	ignore    string
+	gitignore bool
+	listen    string
+	shell     bool
+	quiet     bool
+	verbose   bool
 )
 
-// FileConf structure for pairs of file to watch and command to execute
+// FileConf structure for pairs of file/directory to watch and command to execute
 type FileConf struct {
-	Cmd  string
-	Path string
+	Cmd       string
+	Path      string
+	Dir       string
+	Recursive bool
+	IgnoreExt []string
+	Include   []string
+	Debounce  time.Duration
+	Period    time.Duration
+	Grace     time.Duration
+	Restart   string
+	Shell     bool
+
+	// Type selects the action run on a modification: "exec" (default), "http", or "copy"
+	Type            string
+	URL             string
+	Dest            string
+	IncludeContents bool
+	Timeout         time.Duration
 }
 
 // WatchrConf structure for complete watchr configuration, logging verbosity and FileConf map
 type WatchrConf struct {
-	Quiet   bool
-	Verbose bool
-	Files   []FileConf
+	Quiet            bool
+	Verbose          bool
+	Ignore           []string
+	RespectGitignore bool
+	Listen           string
+	Files            []FileConf
 }
 
 var flags = []cli.Flag{
@@ -53,9 +105,66 @@ var flags = []cli.Flag{
 	cli.StringFlag{
 		Name:        "file",
 		Value:       "",
-		Usage:       "Path to the file to watch for modifications, eg. foobar.go (required)",
+		Usage:       "Path to the file to watch for modifications, eg. foobar.go (required, unless --dir is used)",
 		Destination: &file,
 	},
+	cli.StringFlag{
+		Name:        "dir",
+		Value:       "",
+		Usage:       "Path to a directory to watch for modifications, eg. ./src (required, unless --file is used)",
+		Destination: &dir,
+	},
+	cli.BoolFlag{
+		Name:        "recursive",
+		Usage:       "When used with --dir, also watch all of its subdirectories (optional)",
+		Destination: &recursive,
+	},
+	cli.DurationFlag{
+		Name:        "debounce",
+		Value:       defaultDebounce,
+		Usage:       "Coalesce modification events arriving within this window into a single command run (optional)",
+		Destination: &debounce,
+	},
+	cli.DurationFlag{
+		Name:        "period",
+		Value:       0,
+		Usage:       "Minimum time to wait between consecutive command runs, regardless of how many events arrive (optional)",
+		Destination: &period,
+	},
+	cli.DurationFlag{
+		Name:        "grace",
+		Value:       defaultGrace,
+		Usage:       "Grace period given to a killed command before sending SIGKILL (optional)",
+		Destination: &grace,
+	},
+	cli.StringFlag{
+		Name:        "restart",
+		Value:       "once",
+		Usage:       "How to handle a command still running when a new modification arrives: \"once\" (leave it running) or \"restart\" (kill and restart it) (optional)",
+		Destination: &restart,
+	},
+	cli.StringFlag{
+		Name:        "ignore",
+		Value:       "",
+		Usage:       "Comma-separated glob patterns to ignore, eg. *.log,vendor/** (optional)",
+		Destination: &ignore,
+	},
+	cli.BoolFlag{
+		Name:        "respect-gitignore",
+		Usage:       "When watching a directory, also ignore paths matched by the nearest .gitignore (optional)",
+		Destination: &gitignore,
+	},
+	cli.StringFlag{
+		Name:        "listen",
+		Value:       "",
+		Usage:       "Address to serve /stats (JSON) and /metrics (Prometheus) on, eg. :9090 (optional)",
+		Destination: &listen,
+	},
+	cli.BoolFlag{
+		Name:        "shell",
+		Usage:       "Execute the command through /bin/sh -c instead of tokenizing it, for pipes/redirection (optional)",
+		Destination: &shell,
+	},
 	cli.BoolFlag{
 		Name:        "quiet",
 		Usage:       "Enable quiet operation and supress any and all output (optional, not usable with --verbose)",
@@ -68,16 +177,22 @@ var flags = []cli.Flag{
 	},
 }
 
-func parseFlags(cfg string, file string, cmd string, quiet bool, verbose bool) (err error) {
+func parseFlags(cfg string, file string, dir string, cmd string, restart string, quiet bool, verbose bool) (err error) {
 	// Check if we have --cfg flag passed
-	if cfg != "" && (file != "" || cmd != "" || quiet != false || verbose != false) {
+	if cfg != "" && (file != "" || dir != "" || cmd != "" || quiet != false || verbose != false) {
 		err := errors.New("ERROR: The --cfg flag cannot be used with any other flags")
 		log.Printf("%s\n", err)
 		return err
 	}
-	// Check if we have at least --file flag passed
-	if cfg == "" && file == "" {
-		err := errors.New("ERROR: The --cfg flag with config or --file flag with file path is required")
+	// Check if we have at least --file or --dir flag passed
+	if cfg == "" && file == "" && dir == "" {
+		err := errors.New("ERROR: The --cfg flag with config, --file flag with file path, or --dir flag with directory path is required")
+		log.Printf("%s\n", err)
+		return err
+	}
+
+	if file != "" && dir != "" {
+		err := errors.New("ERROR: The --file and --dir flags are mutually exclusive")
 		log.Printf("%s\n", err)
 		return err
 	}
@@ -88,10 +203,16 @@ func parseFlags(cfg string, file string, cmd string, quiet bool, verbose bool) (
 		return err
 	}
 
+	if restart != "once" && restart != "restart" {
+		err := errors.New("ERROR: The --restart flag must be either \"once\" or \"restart\"")
+		log.Printf("%s\n", err)
+		return err
+	}
+
 	return err
 }
 
-func makeConf(cfg string, file string, cmd string, quiet bool, verbose bool) (conf WatchrConf, err error) {
+func makeConf(cfg string, file string, dir string, cmd string, quiet bool, verbose bool) (conf WatchrConf, err error) {
 	if cfg != "" {
 		viper.SetConfigFile(cfg)
 
@@ -108,11 +229,104 @@ func makeConf(cfg string, file string, cmd string, quiet bool, verbose bool) (co
 		return conf, err
 	}
 
-	conf.Files = append(conf.Files, FileConf{Cmd: cmd, Path: file})
+	conf.Ignore = splitCSV(ignore)
+	conf.RespectGitignore = gitignore
+	conf.Listen = listen
+	conf.Files = append(conf.Files, FileConf{Cmd: cmd, Path: file, Dir: dir, Recursive: recursive, Debounce: debounce, Period: period, Grace: grace, Restart: restart, Shell: shell})
 
 	return conf, err
 }
 
+// splitCSV splits a comma-separated flag value into a trimmed, non-empty slice
+func splitCSV(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	var out []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// completion carries the result of a command run started by startCommand
+type completion struct {
+	exeDur time.Duration
+	out    []string
+	err    error
+}
+
+// restartOutcome carries the result of an in-flight restart back to watchFile's
+// main loop, so the terminate-then-relaunch sequence can run off the event loop.
+type restartOutcome struct {
+	rp  *runningProcess
+	err error
+}
+
+// runningProcess tracks a single in-flight command invocation so it can be
+// killed (on restart or interrupt) and its exit awaited exactly once
+type runningProcess struct {
+	cmd          *exec.Cmd
+	grace        time.Duration
+	done         chan completion
+	terminateOne sync.Once // Guards against a concurrent restart and catchInterrupt both terminating rp
+}
+
+// terminate sends SIGTERM to the command's process group, escalating to
+// SIGKILL after the grace period, and waits for it to actually exit. Safe to
+// call more than once or concurrently; only the first call does any work.
+func (rp *runningProcess) terminate() {
+	if rp == nil || rp.cmd.Process == nil {
+		return
+	}
+
+	rp.terminateOne.Do(func() {
+		pgid, pgidErr := syscall.Getpgid(rp.cmd.Process.Pid)
+		if pgidErr == nil {
+			syscall.Kill(-pgid, syscall.SIGTERM)
+		}
+
+		select {
+		case <-rp.done:
+		case <-time.After(rp.grace):
+			if pgidErr == nil {
+				syscall.Kill(-pgid, syscall.SIGKILL)
+			}
+			<-rp.done
+		}
+	})
+}
+
+var (
+	runningMu  sync.Mutex
+	runningAll = map[*runningProcess]struct{}{}
+)
+
+func registerRunning(rp *runningProcess) {
+	runningMu.Lock()
+	runningAll[rp] = struct{}{}
+	runningMu.Unlock()
+}
+
+func unregisterRunning(rp *runningProcess) {
+	runningMu.Lock()
+	delete(runningAll, rp)
+	runningMu.Unlock()
+}
+
+// terminateAllRunning kills every command currently in flight, so no
+// orphaned child processes are left behind when watchr exits
+func terminateAllRunning() {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	for rp := range runningAll {
+		rp.terminate()
+	}
+}
+
 // catchInterrupt function listens for CTRL^C events and exits the program
 // when detecting one
 func catchInterrupt() {
@@ -123,71 +337,697 @@ func catchInterrupt() {
 		<-interrupt      // Wait for the interrupt to be sent to the channel
 		fmt.Printf("\r") // Supress printing ^C to the terminal
 		log.Println("*** Ctrl+C pressed in Terminal, exiting watchr")
+		terminateAllRunning() // Propagate the signal to any running commands first
 		os.Exit(0)
 	}()
 }
 
-func watchFile(file string, cmd string, quiet bool, verbose bool) {
+// streamLines copies r to the log line by line, prefixed with prefix, until r is closed
+func streamLines(r io.Reader, prefix string, quiet bool, collect *[]string, mu *sync.Mutex) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !quiet {
+			log.Printf("[%s] %s\n", prefix, line)
+		}
+		mu.Lock()
+		*collect = append(*collect, line)
+		mu.Unlock()
+	}
+}
+
+// startCommand starts cmd in its own process group and streams its output,
+// prefixed with prefix, to the logger as it arrives
+func startCommand(cmdLine string, prefix string, quiet bool, grace time.Duration, shell bool) (*runningProcess, error) {
+	var exe *exec.Cmd
+	if shell {
+		exe = exec.CommandContext(context.Background(), "/bin/sh", "-c", cmdLine)
+	} else {
+		args, err := shlex.Split(cmdLine) // Tokenize respecting quotes and backslash escapes
+		if err != nil {
+			return nil, err
+		}
+		if len(args) == 0 {
+			return nil, errors.New("empty command")
+		}
+		exe = exec.CommandContext(context.Background(), args[0], args[1:]...)
+	}
+	exe.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	stdout, err := exe.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := exe.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	exeStart := time.Now()
+	if err := exe.Start(); err != nil {
+		return nil, err
+	}
+
+	rp := &runningProcess{cmd: exe, grace: grace, done: make(chan completion, 1)}
+
+	var outMu sync.Mutex
+	var out []string
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); streamLines(stdout, prefix, quiet, &out, &outMu) }()
+	go func() { defer wg.Done(); streamLines(stderr, prefix, quiet, &out, &outMu) }()
+
+	go func() {
+		wg.Wait()
+		err := exe.Wait()
+		rp.done <- completion{exeDur: time.Since(exeStart), out: out, err: err}
+	}()
+
+	return rp, nil
+}
+
+// watchDirs adds root, and if recursive is set all of its subdirectories, to watcher
+func watchDirs(watcher *fsnotify.Watcher, root string, recursive bool) error {
+	if !recursive {
+		return watcher.Add(root)
+	}
+
+	return filepath.Walk(root, func(path string, inf os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if inf.IsDir() {
+			return watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+// isGlob reports whether path contains glob metacharacters
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// globBase returns the longest non-glob directory prefix of pattern, so it can
+// be handed to the watcher, and whether pattern reaches into subdirectories
+func globBase(pattern string) (base string, recursive bool) {
+	var prefix []string
+	for _, part := range strings.Split(filepath.ToSlash(pattern), "/") {
+		if isGlob(part) {
+			break
+		}
+		prefix = append(prefix, part)
+	}
+
+	base = filepath.Join(prefix...)
+	if base == "" {
+		base = "."
+	}
+	return base, strings.Contains(pattern, "**")
+}
+
+// ignoredExtension reports whether name's extension is in exts, eg. "swp" or ".swp"
+func ignoredExtension(exts []string, name string) bool {
+	ext := strings.TrimPrefix(filepath.Ext(name), ".")
+	for _, e := range exts {
+		if ext == strings.TrimPrefix(e, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAny reports whether name, or its base name, matches any of the glob patterns
+func matchesAny(patterns []string, name string) bool {
+	base := filepath.Base(name)
+	for _, p := range patterns {
+		if ok, _ := doublestar.Match(p, name); ok {
+			return true
+		}
+		if ok, _ := doublestar.Match(p, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// nearestGitignore walks up from dir looking for a .gitignore file and returns
+// its patterns, or nil if none is found
+func nearestGitignore(dir string) []string {
+	for {
+		data, err := os.ReadFile(filepath.Join(dir, ".gitignore"))
+		if err == nil {
+			var patterns []string
+			for _, line := range strings.Split(string(data), "\n") {
+				line = strings.TrimSpace(line)
+				if line == "" || strings.HasPrefix(line, "#") {
+					continue
+				}
+				patterns = append(patterns, line)
+			}
+			return patterns
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil
+		}
+		dir = parent
+	}
+}
+
+// reAddWhenReady waits for path to exist again (editors often rename/replace a file on
+// save instead of writing it in place, which drops it from the watcher) and re-adds it.
+func reAddWhenReady(watcher *fsnotify.Watcher, path string, quiet bool) {
+	for i := 0; i < 50; i++ {
+		if _, err := os.Stat(path); err == nil {
+			if err := watcher.Add(path); err != nil && !quiet {
+				log.Printf("** Failed to re-add %s to the watcher: %s\n", path, err)
+			}
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// histBuckets are the upper bounds, in seconds, of the watchr_command_exec_seconds histogram
+var histBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// fileStats holds the per-file counters served under /stats and /metrics
+type fileStats struct {
+	ModCount     int           `json:"mod_count"`
+	LastModTime  time.Time     `json:"last_mod_time"`
+	LastExitCode int           `json:"last_exit_code"`
+	LastDuration time.Duration `json:"last_duration"`
+	Failures     int           `json:"failures"`
+
+	execSum     float64
+	execCount   int64
+	execBuckets []int64
+}
+
+var (
+	statsMu sync.Mutex
+	stats   = map[string]*fileStats{}
+)
+
+func statsFor(target string) *fileStats {
+	s, ok := stats[target]
+	if !ok {
+		s = &fileStats{execBuckets: make([]int64, len(histBuckets))}
+		stats[target] = s
+	}
+	return s
+}
+
+func recordMod(target string) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	s := statsFor(target)
+	s.ModCount++
+	s.LastModTime = time.Now()
+}
+
+func recordExec(target string, dur time.Duration, err error) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	s := statsFor(target)
+	s.LastDuration = dur
+	s.LastExitCode = exitCode(err)
+	if err != nil {
+		s.Failures++
+	}
+
+	sec := dur.Seconds()
+	s.execSum += sec
+	s.execCount++
+	for i, b := range histBuckets {
+		if sec <= b {
+			s.execBuckets[i]++
+		}
+	}
+}
+
+// exitCode extracts the process exit code from err, or 0/-1 for success/non-exec errors
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	fmt.Fprintln(w, "# HELP watchr_modifications_total Total number of modification events detected per watched file")
+	fmt.Fprintln(w, "# TYPE watchr_modifications_total counter")
+	for target, s := range stats {
+		fmt.Fprintf(w, "watchr_modifications_total{file=%q} %d\n", target, s.ModCount)
+	}
+
+	fmt.Fprintln(w, "# HELP watchr_last_modification_timestamp Unix timestamp of the last detected modification")
+	fmt.Fprintln(w, "# TYPE watchr_last_modification_timestamp gauge")
+	for target, s := range stats {
+		if !s.LastModTime.IsZero() {
+			fmt.Fprintf(w, "watchr_last_modification_timestamp{file=%q} %d\n", target, s.LastModTime.Unix())
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP watchr_command_failures_total Total number of command runs that exited with an error")
+	fmt.Fprintln(w, "# TYPE watchr_command_failures_total counter")
+	for target, s := range stats {
+		fmt.Fprintf(w, "watchr_command_failures_total{file=%q} %d\n", target, s.Failures)
+	}
+
+	fmt.Fprintln(w, "# HELP watchr_command_exec_seconds Command execution time in seconds")
+	fmt.Fprintln(w, "# TYPE watchr_command_exec_seconds histogram")
+	for target, s := range stats {
+		for i, b := range histBuckets {
+			fmt.Fprintf(w, "watchr_command_exec_seconds_bucket{file=%q,le=\"%g\"} %d\n", target, b, s.execBuckets[i])
+		}
+		fmt.Fprintf(w, "watchr_command_exec_seconds_bucket{file=%q,le=\"+Inf\"} %d\n", target, s.execCount)
+		fmt.Fprintf(w, "watchr_command_exec_seconds_sum{file=%q} %g\n", target, s.execSum)
+		fmt.Fprintf(w, "watchr_command_exec_seconds_count{file=%q} %d\n", target, s.execCount)
+	}
+}
+
+// serveStats starts the /stats and /metrics HTTP endpoints on addr
+func serveStats(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", handleStats)
+	mux.HandleFunc("/metrics", handleMetrics)
+
+	log.Printf("*** Serving stats and metrics on %s\n", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// actionContext is the data made available to command and destination templates,
+// eg. {{.Path}}, {{.ModTime}}, {{.Event}}
+type actionContext struct {
+	Path    string
+	ModTime time.Time
+	Event   string
+}
+
+// renderTemplate executes tmplStr as a text/template against ctx, falling back to
+// the raw string if it isn't a valid template
+func renderTemplate(tmplStr string, ctx actionContext) string {
+	tmpl, err := template.New("watchr").Parse(tmplStr)
+	if err != nil {
+		return tmplStr
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, ctx); err != nil {
+		return tmplStr
+	}
+	return buf.String()
+}
+
+// Action is a side effect watchFile can run synchronously when a modification is
+// detected. It covers one-shot actions; running and supervising a long-lived
+// exec command is handled separately in watchFile, since it needs process
+// lifecycle management (streaming, kill/restart) that these don't.
+type Action interface {
+	Run(ctx actionContext) error
+}
+
+// httpAction POSTs a JSON payload describing the modification to a webhook URL
+type httpAction struct {
+	url             string
+	includeContents bool
+	timeout         time.Duration
+}
+
+func (a httpAction) Run(ctx actionContext) error {
+	payload := map[string]interface{}{
+		"path":     ctx.Path,
+		"mod_time": ctx.ModTime,
+		"event":    ctx.Event,
+	}
+	if a.includeContents {
+		contents, err := os.ReadFile(ctx.Path)
+		if err != nil {
+			return err
+		}
+		payload["contents"] = string(contents)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", renderTemplate(a.url, ctx), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// A bounded client so a hanging webhook endpoint can't block the watcher forever
+	client := &http.Client{Timeout: a.timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s returned %s", a.url, resp.Status)
+	}
+	return nil
+}
+
+// copyAction copies the modified file to a templated destination path
+type copyAction struct {
+	dest string
+}
+
+func (a copyAction) Run(ctx actionContext) error {
+	in, err := os.Open(ctx.Path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(renderTemplate(a.dest, ctx))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// buildAction returns the one-shot Action configured for fc, or nil if fc.Type
+// is "exec" (the default), which watchFile runs itself
+func buildAction(fc FileConf) Action {
+	timeout := fc.Timeout
+	if timeout <= 0 {
+		timeout = defaultActionTimeout
+	}
+
+	switch fc.Type {
+	case "http":
+		return httpAction{url: fc.URL, includeContents: fc.IncludeContents, timeout: timeout}
+	case "copy":
+		return copyAction{dest: fc.Dest}
+	default:
+		return nil
+	}
+}
+
+func watchFile(fc FileConf, quiet bool, verbose bool, ignore []string, respectGitignore bool) {
+	target := fc.Path
+	if fc.Dir != "" {
+		target = fc.Dir
+	}
+
 	if !quiet {
-		log.Printf("*** Starting watchr for the file: %s\n", file)
+		log.Printf("*** Starting watchr for: %s\n", target)
 	}
 
-	// Get the watched file stats to store first modification date for comparison later
-	inf, err := os.Stat(file)
+	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer watcher.Close()
+
+	// globPattern is set when Path is a glob, eg. **/*.go, so events can be matched
+	// against it instead of an exact path
+	var globPattern string
+	var recursiveGlob bool // True when globPattern should also watch newly created subdirectories
+
+	switch {
+	case fc.Dir != "":
+		if err := watchDirs(watcher, fc.Dir, fc.Recursive); err != nil {
+			log.Fatal(err)
+		}
+	case isGlob(fc.Path):
+		globPattern = fc.Path
+		base, recursive := globBase(fc.Path)
+		recursiveGlob = recursive
+		if err := watchDirs(watcher, base, recursive); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		if err := watcher.Add(fc.Path); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	watchingDir := fc.Dir != "" || globPattern != ""
 
-	modTime := inf.ModTime()
+	ignorePatterns := append([]string{}, ignore...)
+	if respectGitignore && watchingDir {
+		ignorePatterns = append(ignorePatterns, nearestGitignore(target)...)
+	}
+
+	debounce := fc.Debounce
+	if debounce <= 0 {
+		debounce = defaultDebounce
+	}
+
+	act := buildAction(fc) // nil for fc.Type == "exec" (default), handled inline below
+
+	modTime := time.Now()
+	var lastRun time.Time       // When the command was last successfully run, for --period
+	var lastEventName string    // Path of the event that will trigger the next run, for templating
+	var lastEventOp string      // fsnotify op of that event, for templating
 	var modCount int            // Modifications counter for stats
 	var diff time.Duration      // Difference between last known modification and current modification times
 	var totalDiff time.Duration // Total time between all modifications for stats
 
-	// Main loop, run the modification time comparison and command execution infinitely
+	// debounceTimer fires once events have stopped arriving for the debounce window
+	debounceTimer := time.NewTimer(debounce)
+	debounceTimer.Stop()
+
+	fcGrace := fc.Grace
+	if fcGrace <= 0 {
+		fcGrace = defaultGrace
+	}
+
+	var current *runningProcess // The command run currently in flight, nil if none
+
+	restartCh := make(chan restartOutcome, 1) // Delivers the result of an async restart
+	var restarting bool                       // True while a restart's terminate+relaunch is in flight
+
+	// Main loop, react to filesystem events as they are delivered by the watcher
 	for {
-		// Check the watched file stats again
-		inf, err := os.Stat(file)
-		if err != nil {
-			log.Fatal(err)
+		var currentDone chan completion
+		if current != nil {
+			currentDone = current.done
 		}
 
-		diff = inf.ModTime().Sub(modTime) // Compare last known modTime to the current one
-		if diff != 0 {                    // Time difference detected, file was modified
-			modTime = inf.ModTime() // Save new modTime
-			modCount++              // increase modification counter
-			totalDiff += diff       // add new modification duration to total durations
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+
+			if event.Op&fsnotify.Create == fsnotify.Create {
+				inf, statErr := os.Stat(event.Name)
+				if (fc.Dir != "" && fc.Recursive || recursiveGlob) && statErr == nil && inf.IsDir() {
+					if len(ignorePatterns) > 0 && matchesAny(ignorePatterns, event.Name) {
+						continue
+					}
+					if err := watchDirs(watcher, event.Name, true); err != nil && !quiet {
+						log.Printf("** Failed to watch new directory %s: %s\n", event.Name, err)
+					}
+					continue
+				}
+			}
+
+			if event.Op&(fsnotify.Rename|fsnotify.Remove) != 0 {
+				if fc.Dir == "" && event.Name == fc.Path {
+					go reAddWhenReady(watcher, fc.Path, quiet)
+				}
+				continue
+			}
+
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+
+			if watchingDir {
+				if len(ignorePatterns) > 0 && matchesAny(ignorePatterns, event.Name) {
+					continue
+				}
+				if ignoredExtension(fc.IgnoreExt, event.Name) {
+					continue
+				}
+				if len(fc.Include) > 0 && !matchesAny(fc.Include, event.Name) {
+					continue
+				}
+				if globPattern != "" {
+					if ok, _ := doublestar.Match(globPattern, event.Name); !ok {
+						continue
+					}
+				}
+			}
+
+			now := time.Now()
+			diff = now.Sub(modTime)
+			modTime = now
+			modCount++
+			totalDiff += diff
+			recordMod(target)
+			lastEventName = event.Name
+			lastEventOp = event.Op.String()
 
 			if !quiet {
-				log.Printf("** The file %s was modified at: %s\n", file, inf.ModTime())
+				log.Printf("** The file %s was modified at: %s\n", event.Name, modTime)
+			}
+
+			// Reset the debounce timer so a burst of events only runs the command once
+			if !debounceTimer.Stop() {
+				select {
+				case <-debounceTimer.C:
+				default:
+				}
 			}
+			debounceTimer.Reset(debounce)
 
-			if cmd == "" { // If the --cmd flag was not set and --verbose was, print info
+		case <-debounceTimer.C:
+			if fc.Period > 0 && !lastRun.IsZero() {
+				if elapsed := time.Since(lastRun); elapsed < fc.Period {
+					if !quiet && verbose {
+						log.Printf("* Delaying run, last run was less than %s ago\n", fc.Period)
+					}
+					// The timer already fired and was drained, so it's safe to reset
+					// directly: re-arm for the remainder of the period so this pending
+					// modification still runs once the window clears, instead of being
+					// dropped if no further event arrives in the meantime.
+					debounceTimer.Reset(fc.Period - elapsed)
+					continue
+				}
+			}
+
+			ctx := actionContext{Path: lastEventName, ModTime: modTime, Event: lastEventOp}
+
+			if act != nil { // http/copy actions run synchronously, they have no process to supervise
+				if !quiet {
+					log.Printf("* Running %s action for %s\n", fc.Type, ctx.Path)
+				}
+
+				runStart := time.Now()
+				runErr := act.Run(ctx)
+				recordExec(target, time.Since(runStart), runErr)
+				if runErr == nil {
+					lastRun = time.Now()
+				}
+
+				if runErr != nil && !quiet {
+					log.Printf("** Action failed: %s\n", runErr)
+				}
+				continue
+			}
+
+			if fc.Cmd == "" { // If no command was configured and --verbose was, print info
 				if !quiet && verbose {
 					log.Println("* Not executing any command")
 					log.Printf("** Stats: %d modifications, last modified %s ago, average modification time %s\n",
 						modCount, diff, totalDiff/time.Duration(modCount))
 				}
-			} else { // If the --cmd flag has been set, execute the command provided
+				continue
+			}
+
+			if restarting {
+				if !quiet && verbose {
+					log.Println("* Skipping run, a restart is already in progress")
+				}
+				continue
+			}
+
+			if current != nil {
+				if fc.Restart != "restart" {
+					if !quiet && verbose {
+						log.Println("* Skipping run, the previous command is still running")
+					}
+					continue
+				}
+
 				if !quiet {
-					log.Printf("* Executing: %s\n", cmd)
+					log.Printf("* Restarting: %s\n", fc.Cmd)
 				}
+				restarting = true
+				old := current
+				current = nil
+				cmdLine := renderTemplate(fc.Cmd, ctx)
+				go func() {
+					unregisterRunning(old)
+					old.terminate()
+					rp, err := startCommand(cmdLine, target, quiet, fcGrace, fc.Shell)
+					restartCh <- restartOutcome{rp: rp, err: err}
+				}()
+				continue
+			}
 
-				s := strings.Fields(cmd)         // Split the cmd string into binary and arguments strings
-				bin := s[0]                      // First part of the cmd string is the binary
-				args := strings.Join(s[1:], " ") // Rest of the cmd string are the binary arguments, if any
+			cmdLine := renderTemplate(fc.Cmd, ctx)
+			if !quiet {
+				log.Printf("* Executing: %s\n", cmdLine)
+			}
 
-				exe := exec.Command(bin, args) // Execute the command and store its output
-				exeStart := time.Now()         // Store the time before command execution for measuring its execution time
-				out, err := exe.Output()
-				exeDur := time.Since(exeStart) // Store the execution time of the command for stats
-				if err != nil {
-					log.Fatal(err)
+			rp, err := startCommand(cmdLine, target, quiet, fcGrace, fc.Shell)
+			if err != nil {
+				if !quiet {
+					log.Printf("** Failed to start command: %s\n", err)
 				}
-				if !quiet && verbose {
-					log.Printf("* Command output:\n%s", out)
-					log.Printf("** Stats: %d modifications, last modified %s ago, average modification time %s, command execution %s\n",
-						modCount, diff, totalDiff/time.Duration(modCount), exeDur)
+				continue
+			}
+			current = rp
+			registerRunning(current)
+			lastRun = time.Now()
+
+		case out := <-restartCh:
+			restarting = false
+			if out.err != nil {
+				if !quiet {
+					log.Printf("** Failed to restart command: %s\n", out.err)
 				}
+				continue
+			}
+			current = out.rp
+			registerRunning(current)
+			lastRun = time.Now()
+
+		case c := <-currentDone:
+			unregisterRunning(current)
+			current = nil
+			recordExec(target, c.exeDur, c.err)
+			if c.err != nil && !quiet {
+				log.Printf("** Command exited with error: %s\n", c.err)
+			}
+			if !quiet && verbose {
+				log.Printf("** Stats: %d modifications, last modified %s ago, average modification time %s, command execution %s\n",
+					modCount, diff, totalDiff/time.Duration(modCount), c.exeDur)
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			if !quiet {
+				log.Printf("** Watcher error: %s\n", err)
 			}
 		}
 	}
@@ -198,22 +1038,26 @@ func action(c *cli.Context) error {
 	// Set up interrupt watcher to be able to exit the infinite loop
 	catchInterrupt()
 
-	err := parseFlags(cfg, file, cmd, quiet, verbose)
+	err := parseFlags(cfg, file, dir, cmd, restart, quiet, verbose)
 	if err != nil {
 		cli.ShowAppHelp(c)
 		os.Exit(1)
 	}
 
-	conf, err := makeConf(cfg, file, cmd, quiet, verbose)
+	conf, err := makeConf(cfg, file, dir, cmd, quiet, verbose)
 	if err != nil {
 		cli.ShowAppHelp(c)
 		os.Exit(1)
 	}
 
+	if conf.Listen != "" {
+		go serveStats(conf.Listen)
+	}
+
 	// Main application code
 	for _, i := range conf.Files {
 		wg.Add(1)
-		go watchFile(i.Path, i.Cmd, conf.Quiet, conf.Verbose)
+		go watchFile(i, conf.Quiet, conf.Verbose, conf.Ignore, conf.RespectGitignore)
 	}
 	wg.Wait()
 